@@ -0,0 +1,579 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// chunksPrefix is where resumable, tus.io-style uploads are mounted.
+// A client starts a session with POST, then appends bytes with one or
+// more PATCH requests, and may poll progress with HEAD.
+const chunksPrefix = "/upload/chunks/"
+
+/**
+  chunkSession tracks the state of one resumable upload: how much of
+  the file has been written, the IV used to encrypt it, and whether
+  the client that opened it presented a valid upload cookie. It is
+  persisted to disk so an upload can resume across a server restart.
+*/
+type chunkSession struct {
+	ID         string
+	FileName   string
+	Offset     int64
+	TotalSize  int64
+	IV         [aes.BlockSize]byte
+	Authorized bool
+
+	// HeaderSize is the size in bytes of the frame.go header written
+	// at session creation, so chunk offsets (which count bytes of
+	// ciphertext, per the tus.io Upload-Offset convention) can be
+	// translated into the file's physical byte offsets. Persisting it
+	// on the session means a server restart mid-upload doesn't need to
+	// recompute it.
+	HeaderSize int64
+
+	// Covered records the merged, non-overlapping content ranges
+	// written so far, so PATCHes for disjoint ranges can be admitted
+	// concurrently instead of only ever one at a time in strict
+	// sequence. Offset is kept as the sum of their lengths, which
+	// equals TotalSize exactly once every byte has landed regardless
+	// of the order the chunks arrived in.
+	Covered []byteRange
+
+	mu sync.Mutex
+}
+
+func (s *chunkSession) path(h uploader) string {
+	return filepath.Join(h.HomeBucket, s.FileName)
+}
+
+// overlapsCovered reports whether r overlaps any range already
+// recorded as written - e.g. a retried PATCH for bytes a previous
+// request already completed.
+func (s *chunkSession) overlapsCovered(r byteRange) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.Covered {
+		if r.start < c.end && r.end > c.start {
+			return true
+		}
+	}
+	return false
+}
+
+// commit records r as written, merging it into Covered and updating
+// Offset to the new total, which it returns along with ok=true. It
+// returns ok=false, without recording anything, if r turns out to
+// overlap an already-covered range - a race that rangeLock should
+// have prevented for two genuinely concurrent PATCHes, but is still
+// possible for a replayed one that slipped past the overlapsCovered
+// check before this range was committed.
+func (s *chunkSession) commit(r byteRange) (offset int64, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.Covered {
+		if r.start < c.end && r.end > c.start {
+			return 0, false
+		}
+	}
+
+	merged := append(append([]byteRange{}, s.Covered...), r)
+	sort.Slice(merged, func(i, j int) bool { return merged[i].start < merged[j].start })
+	out := merged[:0:0]
+	for _, c := range merged {
+		if n := len(out); n > 0 && c.start <= out[n-1].end {
+			if c.end > out[n-1].end {
+				out[n-1].end = c.end
+			}
+			continue
+		}
+		out = append(out, c)
+	}
+	s.Covered = out
+
+	var total int64
+	for _, c := range out {
+		total += c.end - c.start
+	}
+	s.Offset = total
+	return total, true
+}
+
+// offset returns the current Offset under lock, since it can be
+// updated concurrently by another PATCH's commit.
+func (s *chunkSession) offset() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Offset
+}
+
+// sessionStore holds the live chunk sessions and the per-file range
+// locks used for parallel chunk writes. It is referenced through a
+// pointer field on uploader so that value-receiver handlers all share
+// the same state instead of copying a locked mutex.
+type sessionStore struct {
+	mu         sync.Mutex
+	sessions   map[string]*chunkSession
+	rangeLocks map[string]*rangeLock
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{
+		sessions:   map[string]*chunkSession{},
+		rangeLocks: map[string]*rangeLock{},
+	}
+}
+
+func (s *sessionStore) dir(homeBucket string) string {
+	return filepath.Join(homeBucket, ".sessions")
+}
+
+// load repopulates the in-memory session map from the persisted
+// session files so that uploads in progress survive a restart.
+func (s *sessionStore) load(homeBucket string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := os.ReadDir(s.dir(homeBucket))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir(homeBucket), e.Name()))
+		if err != nil {
+			log.Printf("error reading session file %s: %v", e.Name(), err)
+			continue
+		}
+		var sess chunkSession
+		if err := json.Unmarshal(data, &sess); err != nil {
+			log.Printf("error parsing session file %s: %v", e.Name(), err)
+			continue
+		}
+		s.sessions[sess.ID] = &sess
+	}
+	return nil
+}
+
+func (s *sessionStore) save(homeBucket string, sess *chunkSession) error {
+	if err := os.MkdirAll(s.dir(homeBucket), 0700); err != nil {
+		return err
+	}
+	// Covered/Offset can be mutated by a concurrent PATCH's commit, so
+	// marshaling needs the same lock that guards them.
+	sess.mu.Lock()
+	data, err := json.Marshal(sess)
+	sess.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(s.dir(homeBucket), sess.ID+".json"), data, 0600)
+}
+
+func (s *sessionStore) get(id string) *chunkSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions[id]
+}
+
+func (s *sessionStore) put(sess *chunkSession) {
+	s.mu.Lock()
+	s.sessions[sess.ID] = sess
+	s.mu.Unlock()
+}
+
+func (s *sessionStore) rangeLockFor(fileName string) *rangeLock {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rl := s.rangeLocks[fileName]
+	if rl == nil {
+		rl = newRangeLock()
+		s.rangeLocks[fileName] = rl
+	}
+	return rl
+}
+
+func genSessionID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// byteRange is a half-open [start, end) range of a file.
+type byteRange struct {
+	start, end int64
+}
+
+// rangeLock lets multiple PATCHes write disjoint byte ranges of the
+// same file concurrently, while overlapping ranges block until the
+// earlier writer releases its range.
+type rangeLock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	locked []byteRange
+}
+
+func newRangeLock() *rangeLock {
+	rl := &rangeLock{}
+	rl.cond = sync.NewCond(&rl.mu)
+	return rl
+}
+
+func (rl *rangeLock) overlapsLocked(r byteRange) bool {
+	for _, l := range rl.locked {
+		if r.start < l.end && r.end > l.start {
+			return true
+		}
+	}
+	return false
+}
+
+func (rl *rangeLock) lock(r byteRange) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for rl.overlapsLocked(r) {
+		rl.cond.Wait()
+	}
+	rl.locked = append(rl.locked, r)
+}
+
+func (rl *rangeLock) unlock(r byteRange) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for i, l := range rl.locked {
+		if l == r {
+			rl.locked = append(rl.locked[:i], rl.locked[i+1:]...)
+			break
+		}
+	}
+	rl.cond.Broadcast()
+}
+
+// ctrStreamAt builds the CTR keystream as it would stand after
+// encrypting offset bytes, so a chunk starting mid-file can be
+// encrypted without replaying everything before it.
+func ctrStreamAt(key []byte, iv [aes.BlockSize]byte, offset int64) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	blockSize := int64(block.BlockSize())
+	blockIndex := big.NewInt(offset / blockSize)
+	skip := int(offset % blockSize)
+
+	counter := new(big.Int).SetBytes(iv[:])
+	counter.Add(counter, blockIndex)
+	counterBytes := counter.Bytes()
+
+	var seeked [aes.BlockSize]byte
+	if len(counterBytes) > aes.BlockSize {
+		counterBytes = counterBytes[len(counterBytes)-aes.BlockSize:]
+	}
+	copy(seeked[aes.BlockSize-len(counterBytes):], counterBytes)
+
+	stream := cipher.NewCTR(block, seeked[:])
+	if skip > 0 {
+		discard := make([]byte, skip)
+		stream.XORKeyStream(discard, discard)
+	}
+	return stream, nil
+}
+
+// chunkWriter XORs each PATCH body with the keystream for its offset
+// and writes it to the target file with WriteAt, holding the range
+// lock for [start, end) until Close.
+type chunkWriter struct {
+	f      *os.File
+	stream cipher.Stream
+	offset int64
+	rl     *rangeLock
+	r      byteRange
+}
+
+// OpenChunkWriter opens fileName for encrypting the half-open content
+// range [offset, offset+length) under the given IV and writing the
+// result at writeOffset, the matching physical position in the file
+// (which leads the content offset by the frame header's size). The
+// keystream and the range lock are keyed by the content offset, not
+// the physical one, so they stay meaningful regardless of where the
+// content happens to start in the file. Writers for disjoint content
+// ranges of the same file may run in parallel; writers for
+// overlapping ranges block until the earlier one closes.
+func (h uploader) OpenChunkWriter(fileName string, offset, writeOffset, length int64, iv [aes.BlockSize]byte) (io.WriteCloser, error) {
+	f, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := ctrStreamAt(h.Key, iv, offset)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r := byteRange{start: offset, end: offset + length}
+	rl := h.Sessions.rangeLockFor(fileName)
+	rl.lock(r)
+	return &chunkWriter{f: f, stream: stream, offset: writeOffset, rl: rl, r: r}, nil
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	c := make([]byte, len(p))
+	cw.stream.XORKeyStream(c, p)
+	n, err := cw.f.WriteAt(c, cw.offset)
+	cw.offset += int64(n)
+	return n, err
+}
+
+func (cw *chunkWriter) Close() error {
+	cw.rl.unlock(cw.r)
+	return cw.f.Close()
+}
+
+// newChunkSession allocates a session and lays down the same frame.go
+// header (magic, version, per-file IV, original name) that a plain
+// upload writes, so the bytes PATCH appends land after it and the
+// finished file is readable by the ordinary download path. Without
+// this, a chunked upload's ciphertext would be indistinguishable from
+// a legacy unframed file and get decrypted with the wrong (fixed) IV.
+func (h uploader) newChunkSession(fileName string, totalSize int64) (*chunkSession, error) {
+	id, err := genSessionID()
+	if err != nil {
+		return nil, err
+	}
+	var iv [aes.BlockSize]byte
+	if _, err := rand.Read(iv[:]); err != nil {
+		return nil, err
+	}
+	sess := &chunkSession{
+		ID:         id,
+		FileName:   fileName,
+		TotalSize:  totalSize,
+		IV:         iv,
+		Authorized: true,
+	}
+
+	f, err := os.OpenFile(sess.path(h), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := writeFileHeader(f, iv, filepath.Base(fileName)); err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	sess.HeaderSize = info.Size()
+
+	h.Sessions.put(sess)
+	return sess, h.Sessions.save(h.HomeBucket, sess)
+}
+
+// finalizeChunkSession is called once a session's last byte has been
+// written. It appends the HMAC-SHA256 trailer over the session's
+// ciphertext, the same trailer serveHTTPUploadPOSTDrain writes for a
+// plain upload, so the finished file reads back through the ordinary
+// framed-file path in serveHTTPDownloadGET.
+func (h uploader) finalizeChunkSession(sess *chunkSession) error {
+	f, err := os.OpenFile(sess.path(h), os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	mac := hmac.New(sha256.New, h.Key)
+	cipherText := io.NewSectionReader(f, sess.HeaderSize, sess.TotalSize)
+	if _, err := io.Copy(mac, cipherText); err != nil {
+		return err
+	}
+	_, err = f.WriteAt(mac.Sum(nil), sess.HeaderSize+sess.TotalSize)
+	return err
+}
+
+/**
+  Dispatch the three resumable-upload verbs mounted under
+  /upload/chunks/: POST allocates a session, PATCH appends an
+  encrypted chunk, HEAD reports the current offset for resume.
+*/
+func (h uploader) serveHTTPUploadChunks(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, chunksPrefix)
+	switch r.Method {
+	case "POST":
+		if id != "" {
+			http.Error(w, "session id must not be given on POST", 400)
+			return
+		}
+		h.serveHTTPUploadChunksPOST(w, r)
+	case "PATCH":
+		h.serveHTTPUploadChunksPATCH(id, w, r)
+	case "HEAD":
+		h.serveHTTPUploadChunksHEAD(id, w, r)
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
+
+func (h uploader) serveHTTPUploadChunksPOST(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("uploadCookie") != h.UploadCookie {
+		log.Printf("failed authorization for chunked session")
+		http.Error(w, "failed authorization for file", 400)
+		return
+	}
+	fileName, err := sanitizeName(r.URL.Query().Get("fileName"))
+	if err != nil {
+		log.Printf("rejected chunked upload file name: %v", err)
+		http.Error(w, "invalid fileName", 400)
+		return
+	}
+	totalSize, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || totalSize < 0 {
+		http.Error(w, "missing or invalid Upload-Length", 400)
+		return
+	}
+	if h.MaxFileBytes > 0 && totalSize > h.MaxFileBytes {
+		log.Printf("chunked upload of %d bytes exceeds MaxFileBytes", totalSize)
+		http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	sess, err := h.newChunkSession(fileName, totalSize)
+	if err != nil {
+		log.Printf("error creating chunk session: %v", err)
+		http.Error(w, "error creating chunk session", 500)
+		return
+	}
+	w.Header().Set("Location", chunksPrefix+sess.ID)
+	w.Header().Set("Upload-Offset", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h uploader) serveHTTPUploadChunksPATCH(id string, w http.ResponseWriter, r *http.Request) {
+	sess := h.Sessions.get(id)
+	if sess == nil {
+		http.Error(w, "unknown upload session", 404)
+		return
+	}
+	if !sess.Authorized {
+		http.Error(w, "failed authorization for file", 400)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "missing or invalid Upload-Offset", 400)
+		return
+	}
+	if r.ContentLength < 0 {
+		http.Error(w, "Content-Length is required", 411)
+		return
+	}
+	rng := byteRange{start: offset, end: offset + r.ContentLength}
+	if rng.end > sess.TotalSize {
+		http.Error(w, fmt.Sprintf("range extends past the declared Upload-Length of %d", sess.TotalSize), 409)
+		return
+	}
+	// Rejecting an already-written range here (rather than just
+	// letting rangeLock serialize it) is what lets two PATCHes for
+	// disjoint ranges actually run at once: neither blocks on the
+	// other, and only a replay of already-completed bytes is refused.
+	if sess.overlapsCovered(rng) {
+		http.Error(w, "range already written", 409)
+		return
+	}
+
+	if h.MaxRequestBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, h.MaxRequestBytes)
+	}
+
+	timer := newProgressTimer(w, h.IdleUploadTimeout)
+	timer.touch()
+	body := &progressReader{r: r.Body, timer: timer}
+	throttled := &throttledReader{r: body, buckets: []*tokenBucket{h.UploadBucket, queryBytesPerSec(r, "maxUploadBytesPerSec")}}
+
+	// offset/sess.Offset count ciphertext bytes from the client's point
+	// of view; the frame header pushes the physical write position out
+	// by HeaderSize, but the keystream must still be derived from the
+	// content offset.
+	writer, err := h.OpenChunkWriter(sess.path(h), offset, sess.HeaderSize+offset, r.ContentLength, sess.IV)
+	if err != nil {
+		log.Printf("error opening chunk writer: %v", err)
+		http.Error(w, "error opening chunk writer", 500)
+		return
+	}
+	n, copyErr := io.Copy(writer, io.LimitReader(throttled, r.ContentLength))
+	addUploadBytes(n)
+	closeErr := writer.Close()
+	if copyErr != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(copyErr, &maxBytesErr) {
+			log.Printf("chunk body exceeded MaxRequestBytes")
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		log.Printf("error writing chunk: %v", copyErr)
+		http.Error(w, "error writing chunk", 500)
+		return
+	}
+	if closeErr != nil {
+		log.Printf("error closing chunk file: %v", closeErr)
+		http.Error(w, "error closing chunk file", 500)
+		return
+	}
+
+	newOffset, ok := sess.commit(rng)
+	if n != rng.end-rng.start || !ok {
+		log.Printf("chunk for %s [%d,%d) did not commit cleanly", sess.FileName, rng.start, rng.end)
+		http.Error(w, "error committing chunk", 500)
+		return
+	}
+	if err := h.Sessions.save(h.HomeBucket, sess); err != nil {
+		log.Printf("error persisting chunk session: %v", err)
+	}
+
+	if newOffset >= sess.TotalSize {
+		if err := h.finalizeChunkSession(sess); err != nil {
+			log.Printf("error finalizing chunk session: %v", err)
+			http.Error(w, "error finalizing upload", 500)
+			return
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+	if newOffset >= sess.TotalSize {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (h uploader) serveHTTPUploadChunksHEAD(id string, w http.ResponseWriter, r *http.Request) {
+	sess := h.Sessions.get(id)
+	if sess == nil {
+		http.Error(w, "unknown upload session", 404)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(sess.offset(), 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(sess.TotalSize, 10))
+	w.WriteHeader(http.StatusOK)
+}
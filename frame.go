@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// frameMagic/frameVersion identify a file written with a per-file
+// random IV, as opposed to the legacy layout that reused uploader.IV
+// (fixed server-wide) for every file, which is unsafe under CTR mode.
+const (
+	frameMagic   = "UP1\x00"
+	frameVersion = byte(1)
+)
+
+// errNotFramed means the file doesn't start with frameMagic, so it
+// predates per-file IVs and should be read with the legacy fixed IV.
+var errNotFramed = errors.New("file does not start with the frame magic bytes")
+
+// errIntegrityCheckFailed means the trailing HMAC tag didn't match the
+// file's ciphertext, i.e. the file was corrupted or tampered with.
+var errIntegrityCheckFailed = errors.New("file failed HMAC integrity check")
+
+const hmacTagSize = sha256.Size
+
+// fileHeader is framed at the start of every upload: magic, version,
+// the random IV used for that file, and the original file name. The
+// ciphertext follows, then an HMAC-SHA256 tag over the ciphertext.
+type fileHeader struct {
+	IV         [aes.BlockSize]byte
+	FileName   string
+	HeaderSize int64
+}
+
+func writeFileHeader(w io.Writer, iv [aes.BlockSize]byte, fileName string) error {
+	if _, err := io.WriteString(w, frameMagic); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte{frameVersion}); err != nil {
+		return err
+	}
+	if _, err := w.Write(iv[:]); err != nil {
+		return err
+	}
+	nameBytes := []byte(fileName)
+	var nameLen [2]byte
+	binary.BigEndian.PutUint16(nameLen[:], uint16(len(nameBytes)))
+	if _, err := w.Write(nameLen[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(nameBytes)
+	return err
+}
+
+// readFileHeader parses a fileHeader from the start of r. It returns
+// errNotFramed (without consuming more than the magic bytes' worth of
+// meaning to the caller) when the file predates framing.
+func readFileHeader(r io.Reader) (fileHeader, error) {
+	var h fileHeader
+
+	magic := make([]byte, len(frameMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return h, err
+	}
+	if string(magic) != frameMagic {
+		return h, errNotFramed
+	}
+
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(r, version); err != nil {
+		return h, err
+	}
+
+	if _, err := io.ReadFull(r, h.IV[:]); err != nil {
+		return h, err
+	}
+
+	var nameLen [2]byte
+	if _, err := io.ReadFull(r, nameLen[:]); err != nil {
+		return h, err
+	}
+	nameBytes := make([]byte, binary.BigEndian.Uint16(nameLen[:]))
+	if _, err := io.ReadFull(r, nameBytes); err != nil {
+		return h, err
+	}
+	h.FileName = string(nameBytes)
+	h.HeaderSize = int64(len(frameMagic) + 1 + aes.BlockSize + 2 + len(nameBytes))
+	return h, nil
+}
+
+// verifyHMAC recomputes the HMAC-SHA256 tag over cipherText and
+// compares it against tag, in constant time.
+func verifyHMAC(key []byte, cipherText io.Reader, tag []byte) error {
+	mac := hmac.New(sha256.New, key)
+	if _, err := io.Copy(mac, cipherText); err != nil {
+		return err
+	}
+	if !hmac.Equal(mac.Sum(nil), tag) {
+		return errIntegrityCheckFailed
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+/**
+  progressTimer pushes an http.ResponseController's read/write
+  deadlines forward every time bytes actually flow, so a stalled
+  connection dies after N seconds of silence rather than the server
+  cutting off a large-but-healthy transfer at some fixed wall-clock
+  limit.
+*/
+type progressTimer struct {
+	rc   *http.ResponseController
+	idle time.Duration
+}
+
+func newProgressTimer(w http.ResponseWriter, idle time.Duration) *progressTimer {
+	return &progressTimer{rc: http.NewResponseController(w), idle: idle}
+}
+
+// touch pushes both deadlines out by idle from now. A zero idle
+// disables the timer, same convention as the other uploader limits.
+func (p *progressTimer) touch() {
+	if p.idle <= 0 {
+		return
+	}
+	deadline := time.Now().Add(p.idle)
+	p.rc.SetReadDeadline(deadline)
+	p.rc.SetWriteDeadline(deadline)
+}
+
+// progressReader touches the timer on every read that actually
+// returns bytes.
+type progressReader struct {
+	r     io.Reader
+	timer *progressTimer
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.timer.touch()
+	}
+	return n, err
+}
+
+// progressWriter is the write-side counterpart of progressReader.
+type progressWriter struct {
+	w     io.Writer
+	timer *progressTimer
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	if n > 0 {
+		p.timer.touch()
+	}
+	return n, err
+}
+
+// progressReadCloser re-attaches a Closer to a progressReader so it
+// can stand in for an http.Request's io.ReadCloser body.
+type progressReadCloser struct {
+	io.Reader
+	io.Closer
+}
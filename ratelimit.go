@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/**
+  tokenBucket is a classic token-bucket rate limiter: tokens refill at
+  Rate bytes/sec up to Burst, and Take blocks until enough tokens are
+  available. A single tokenBucket can be shared across many readers
+  and writers so that, e.g., all downloads together are capped at the
+  server's configured egress rate.
+*/
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes/sec
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bytesPerSec int64) *tokenBucket {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	rate := float64(bytesPerSec)
+	return &tokenBucket{
+		rate:   rate,
+		burst:  rate,
+		tokens: rate,
+		last:   time.Now(),
+	}
+}
+
+// take blocks until n tokens are available, then consumes them.
+func (b *tokenBucket) take(n int) {
+	if b == nil || n <= 0 {
+		return
+	}
+	need := float64(n)
+	b.mu.Lock()
+	for {
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+		if b.tokens >= need {
+			b.tokens -= need
+			b.mu.Unlock()
+			return
+		}
+		wait := time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+		time.Sleep(wait)
+		b.mu.Lock()
+	}
+}
+
+// throttledReader drains tokens from one or more buckets as bytes
+// flow through Read, blocking the caller (and thus the stream being
+// copied) until tokens are available.
+type throttledReader struct {
+	r       io.Reader
+	buckets []*tokenBucket
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	for _, b := range t.buckets {
+		b.take(n)
+	}
+	return n, err
+}
+
+// throttledWriter is the Write-side counterpart of throttledReader. It
+// flushes after every write so downloads stream at a steady rate
+// instead of bursting out of a buffer once it fills.
+type throttledWriter struct {
+	w       io.Writer
+	buckets []*tokenBucket
+	flusher http.Flusher
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	for _, b := range t.buckets {
+		b.take(n)
+	}
+	if t.flusher != nil {
+		t.flusher.Flush()
+	}
+	return n, err
+}
+
+// queryBytesPerSec parses a per-request rate override from the query
+// string, returning nil when absent or invalid so the caller falls
+// back to the server-wide default.
+func queryBytesPerSec(r *http.Request, param string) *tokenBucket {
+	v := r.URL.Query().Get(param)
+	if v == "" {
+		return nil
+	}
+	bytesPerSec, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return nil
+	}
+	return newTokenBucket(bytesPerSec)
+}
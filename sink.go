@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Sink is anywhere an uploaded file's ciphertext can be streamed to,
+// so serveHTTPUploadPOSTDrain never has to assume it is writing to
+// local disk.
+type Sink interface {
+	NewSink(name string) (io.WriteCloser, error)
+}
+
+// Source is the download-side counterpart of Sink.
+type Source interface {
+	NewSource(name string) (io.ReadCloser, error)
+}
+
+// sinkRemover is implemented by Sinks that can clean up a partially
+// written object, e.g. when a per-file size quota is exceeded mid-upload.
+type sinkRemover interface {
+	Remove(name string) error
+}
+
+// statReaderAt is satisfied by sources that support random access
+// (like *os.File), which lets serveHTTPDownloadGET verify the trailing
+// HMAC tag before streaming any plaintext to the client. Sources that
+// only offer a sequential io.ReadCloser (e.g. a cloud GetObject body)
+// don't get that pre-verification pass.
+type statReaderAt interface {
+	io.ReaderAt
+	Stat() (os.FileInfo, error)
+}
+
+// backendCtor builds the Sink/Source pair for one "--backend" scheme,
+// rooted at the bucket/path that follows "scheme://".
+type backendCtor func(root string) (Sink, Source, error)
+
+// backends maps a "--backend" scheme to its constructor. "file" is
+// registered here; "s3" and "gcs" register themselves from an init()
+// in their own build-tag-guarded source file (sink_s3.go/sink_gcs.go),
+// the same self-registration pattern database/sql drivers use.
+var backends = map[string]backendCtor{
+	"file": newDiskBackend,
+}
+
+func registerBackend(scheme string, ctor backendCtor) {
+	backends[scheme] = ctor
+}
+
+// parseBackend turns a "--backend" flag value such as "s3://my-bucket"
+// into a Sink/Source pair. A bare path with no "scheme://" prefix is
+// treated as a local directory.
+func parseBackend(spec string) (Sink, Source, error) {
+	scheme, root := "file", spec
+	if i := strings.Index(spec, "://"); i >= 0 {
+		scheme, root = spec[:i], spec[i+len("://"):]
+	}
+	ctor, ok := backends[scheme]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown storage backend %q (known: %v)", scheme, knownSchemes())
+	}
+	return ctor(root)
+}
+
+func knownSchemes() []string {
+	schemes := make([]string, 0, len(backends))
+	for scheme := range backends {
+		schemes = append(schemes, scheme)
+	}
+	return schemes
+}
+
+// sanitizeName rejects a name that could let a file escape the
+// storage root it's joined onto: empty, absolute, or containing a
+// ".." segment once cleaned. Every backend's NewSink/NewSource/Remove
+// must run the caller-supplied name through this before using it,
+// since it ultimately comes from an HTTP client (a multipart part's
+// filename, a download URL's tail, a chunked upload's fileName query
+// parameter).
+func sanitizeName(name string) (string, error) {
+	clean := filepath.Clean(name)
+	if clean == "." || clean == "" {
+		return "", fmt.Errorf("file name must not be empty")
+	}
+	if filepath.IsAbs(clean) {
+		return "", fmt.Errorf("file name must not be absolute: %q", name)
+	}
+	if clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("file name must not escape the storage root: %q", name)
+	}
+	return clean, nil
+}
+
+// diskBackend is the default Sink/Source: plain files under a local
+// directory, same as the server's original os.Create/os.Open calls.
+type diskBackend struct {
+	root string
+}
+
+func newDiskBackend(root string) (Sink, Source, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, nil, err
+	}
+	return diskBackend{root}, diskBackend{root}, nil
+}
+
+func (d diskBackend) NewSink(name string) (io.WriteCloser, error) {
+	clean, err := sanitizeName(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Create(filepath.Join(d.root, clean))
+}
+
+func (d diskBackend) NewSource(name string) (io.ReadCloser, error) {
+	clean, err := sanitizeName(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(filepath.Join(d.root, clean))
+}
+
+func (d diskBackend) Remove(name string) error {
+	clean, err := sanitizeName(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(d.root, clean))
+}
@@ -0,0 +1,44 @@
+//go:build gcs
+
+package main
+
+import (
+	"context"
+	"io"
+
+	"cloud.google.com/go/storage"
+)
+
+func init() {
+	registerBackend("gcs", newGCSBackend)
+}
+
+// gcsBackend mirrors the streaming pattern of storage.Writer: Write
+// calls go straight to the object, nothing is buffered locally.
+type gcsBackend struct {
+	bucket *storage.BucketHandle
+}
+
+func newGCSBackend(bucket string) (Sink, Source, error) {
+	client, err := storage.NewClient(context.Background())
+	if err != nil {
+		return nil, nil, err
+	}
+	return gcsBackend{bucket: client.Bucket(bucket)}, gcsBackend{bucket: client.Bucket(bucket)}, nil
+}
+
+func (b gcsBackend) NewSink(name string) (io.WriteCloser, error) {
+	clean, err := sanitizeName(name)
+	if err != nil {
+		return nil, err
+	}
+	return b.bucket.Object(clean).NewWriter(context.Background()), nil
+}
+
+func (b gcsBackend) NewSource(name string) (io.ReadCloser, error) {
+	clean, err := sanitizeName(name)
+	if err != nil {
+		return nil, err
+	}
+	return b.bucket.Object(clean).NewReader(context.Background())
+}
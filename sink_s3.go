@@ -0,0 +1,97 @@
+//go:build s3
+
+package main
+
+import (
+	"io"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+func init() {
+	registerBackend("s3", newS3Backend)
+}
+
+// s3Backend streams ciphertext straight into a bucket with a
+// pipe-backed multipart uploader, so a file never touches local disk
+// or an in-memory buffer on its way to S3.
+type s3Backend struct {
+	bucket string
+	sess   *session.Session
+}
+
+func newS3Backend(bucket string) (Sink, Source, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, nil, err
+	}
+	b := s3Backend{bucket: bucket, sess: sess}
+	return b, b, nil
+}
+
+func (b s3Backend) NewSink(name string) (io.WriteCloser, error) {
+	clean, err := sanitizeName(name)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	up := s3manager.NewUploader(b.sess)
+	done := make(chan error, 1)
+	go func() {
+		_, err := up.Upload(&s3manager.UploadInput{
+			Bucket: aws.String(b.bucket),
+			Key:    aws.String(clean),
+			Body:   pr,
+		})
+		pr.CloseWithError(err)
+		done <- err
+	}()
+	return &s3PipeSink{pw: pw, done: done}, nil
+}
+
+func (b s3Backend) NewSource(name string) (io.ReadCloser, error) {
+	clean, err := sanitizeName(name)
+	if err != nil {
+		return nil, err
+	}
+	out, err := s3.New(b.sess).GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(clean),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// s3PipeSink feeds Write calls into the pipe that s3manager.Upload is
+// reading from, and Close waits for the upload goroutine to finish so
+// callers see a real error instead of "written, probably". Close is
+// idempotent: a caller on an error path (e.g. a MaxFileBytes quota
+// hit) may close it once to abort the upload and again via a deferred
+// Close, and the second call must not re-block on <-p.done.
+type s3PipeSink struct {
+	pw       *io.PipeWriter
+	done     chan error
+	closeErr error
+	closeOne sync.Once
+}
+
+func (p *s3PipeSink) Write(b []byte) (int, error) {
+	return p.pw.Write(b)
+}
+
+func (p *s3PipeSink) Close() error {
+	p.closeOne.Do(func() {
+		if err := p.pw.Close(); err != nil {
+			p.closeErr = err
+			return
+		}
+		p.closeErr = <-p.done
+	})
+	return p.closeErr
+}
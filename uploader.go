@@ -3,6 +3,11 @@ package main
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -30,6 +35,49 @@ type uploader struct {
 	BufferSize   int
 	Key          []byte
 	IV           [aes.BlockSize]byte
+	// Sessions tracks in-progress resumable uploads. It is a pointer so
+	// that copies of uploader (handlers use a value receiver) share the
+	// same session map and range locks instead of forking them.
+	Sessions *sessionStore
+
+	// MaxUploadBytesPerSec/MaxDownloadBytesPerSec, if positive, cap the
+	// combined throughput of all uploads/downloads via UploadBucket and
+	// DownloadBucket, which are shared (pointer) token buckets so every
+	// in-flight session draws from the same budget.
+	MaxUploadBytesPerSec   int64
+	MaxDownloadBytesPerSec int64
+	UploadBucket           *tokenBucket
+	DownloadBucket         *tokenBucket
+
+	// MaxRequestBytes caps the whole multipart body (0 = unlimited).
+	// MaxFileBytes caps any single part's decoded size; a part that
+	// would exceed it fails the request with 413 and its partial file
+	// is removed. MaxFilesPerRequest caps the number of file parts,
+	// to stop a request made of thousands of tiny parts.
+	MaxRequestBytes    int64
+	MaxFileBytes       int64
+	MaxFilesPerRequest int
+
+	// Sink/Source decouple the handlers from local disk, so a single
+	// "--backend" flag in makeServer can point uploads/downloads at S3,
+	// GCS, or (the default) a directory on local disk.
+	Sink   Sink
+	Source Source
+
+	// IdleUploadTimeout/IdleDownloadTimeout bound how long a request may
+	// go without any bytes flowing, not how long the transfer may take
+	// in total - a slow-but-steady multi-gigabyte file shouldn't die
+	// just because it's big.
+	IdleUploadTimeout   time.Duration
+	IdleDownloadTimeout time.Duration
+
+	// MaxConcurrentSessions, if positive, caps how many upload/download
+	// requests may run at once. AdmissionSlots is the semaphore that
+	// enforces it: ServeHTTP takes a non-blocking claim on it via admit
+	// and answers 503 immediately rather than queuing when it's full, so
+	// sessions that were admitted are never starved by ones that weren't.
+	MaxConcurrentSessions int
+	AdmissionSlots        chan struct{}
 }
 
 // CountingStreamReader takes statistics as it writes
@@ -72,20 +120,49 @@ func (w CountingStreamWriter) Close() error {
 	return nil
 }
 
-func doCipherByReaderWriter(inFile io.Reader, outFile io.Writer, key []byte, iv [aes.BlockSize]byte) error {
+func doCipherByReaderWriter(inFile io.Reader, outFile io.Writer, key []byte, iv [aes.BlockSize]byte) (int64, error) {
 	writeCipher, err := aes.NewCipher(key)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	writeCipherStream := cipher.NewCTR(writeCipher, iv[:])
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	reader := &CountingStreamReader{S: writeCipherStream, R: inFile}
-	_, err = io.Copy(outFile, reader)
+	return io.Copy(outFile, reader)
+}
 
-	return err
+// errFileTooLarge is returned by serveHTTPUploadPOSTDrain when a part
+// exceeds uploader.MaxFileBytes, so the caller can answer 413 instead
+// of the generic 500 used for other drain failures.
+var errFileTooLarge = fmt.Errorf("file exceeds the per-file size limit")
+
+// quotaReader enforces a cap of n bytes read from r. Unlike
+// io.LimitReader it notices when the underlying reader still had more
+// to give once the cap was hit, so callers can tell "exactly fit" from
+// "truncated".
+type quotaReader struct {
+	r        io.Reader
+	n        int64
+	exceeded bool
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	if q.n <= 0 {
+		probe := make([]byte, 1)
+		if n, _ := q.r.Read(probe); n > 0 {
+			q.exceeded = true
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > q.n {
+		p = p[:q.n]
+	}
+	n, err := q.r.Read(p)
+	q.n -= int64(n)
+	return n, err
 }
 
 /**
@@ -94,15 +171,48 @@ func doCipherByReaderWriter(inFile io.Reader, outFile io.Writer, key []byte, iv
   The part name (or file name, content type, etc) may insinuate that the file
   is small, and should be held in memory.
 */
-func (h uploader) serveHTTPUploadPOSTDrain(fileName string, w http.ResponseWriter, part *multipart.Part) error {
+func (h uploader) serveHTTPUploadPOSTDrain(fileName string, w http.ResponseWriter, part *multipart.Part, r *http.Request) error {
 	log.Printf("read part %s", fileName)
-	drainTo, drainErr := os.Create(fileName)
+	drainTo, drainErr := h.Sink.NewSink(fileName)
 	if drainErr != nil {
 		log.Printf("error draining file: %v", drainErr)
+		return drainErr
 	}
 	defer drainTo.Close()
 
-	return doCipherByReaderWriter(part, drainTo, h.Key, h.IV)
+	var iv [aes.BlockSize]byte
+	if _, err := rand.Read(iv[:]); err != nil {
+		return err
+	}
+	if err := writeFileHeader(drainTo, iv, part.FileName()); err != nil {
+		return err
+	}
+
+	mac := hmac.New(sha256.New, h.Key)
+	tee := io.MultiWriter(drainTo, mac)
+
+	throttled := &throttledReader{r: part, buckets: []*tokenBucket{h.UploadBucket, queryBytesPerSec(r, "maxUploadBytesPerSec")}}
+
+	var limited io.Reader = throttled
+	var quota *quotaReader
+	if h.MaxFileBytes > 0 {
+		quota = &quotaReader{r: throttled, n: h.MaxFileBytes}
+		limited = quota
+	}
+
+	n, err := doCipherByReaderWriter(limited, tee, h.Key, iv)
+	addUploadBytes(n)
+	if quota != nil && quota.exceeded {
+		if remover, ok := h.Sink.(sinkRemover); ok {
+			remover.Remove(fileName)
+		}
+		return errFileTooLarge
+	}
+	if err != nil {
+		return err
+	}
+	_, err = drainTo.Write(mac.Sum(nil))
+	return err
 }
 
 /**
@@ -188,12 +298,21 @@ func (h uploader) checkUploadCookie(part *multipart.Part) bool {
 
   If we have an SLA to handle a certain number of connections,
   putting an upper bound on memory usage per session lets us
-  have such a guarantee, where we can use admission control (TBD)
-  to limit the number of sessions to amounts within the SLA
-  to ensure that sessions started can complete without interference
-  from sessions that are doomed to fail from congestion.
+  have such a guarantee, where we use admission control
+  (uploader.admit, gated by MaxConcurrentSessions) to limit the
+  number of sessions to amounts within the SLA, so that sessions
+  already started can complete without interference from sessions
+  that would otherwise be doomed to fail from congestion.
 */
 func (h uploader) serveHTTPUploadPOST(w http.ResponseWriter, r *http.Request) {
+	if h.MaxRequestBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, h.MaxRequestBytes)
+	}
+
+	timer := newProgressTimer(w, h.IdleUploadTimeout)
+	timer.touch()
+	r.Body = progressReadCloser{Reader: &progressReader{r: r.Body, timer: timer}, Closer: r.Body}
+
 	multipartReader, err := r.MultipartReader()
 	if err != nil {
 		log.Printf("failed to get a multipart reader %v", err)
@@ -202,6 +321,7 @@ func (h uploader) serveHTTPUploadPOST(w http.ResponseWriter, r *http.Request) {
 	}
 
 	isAuthorized := false
+	filesSeen := 0
 	for {
 		//DOS problem .... what if this header is very large?  (Intentionally)
 		part, partErr := multipartReader.NextPart()
@@ -209,6 +329,12 @@ func (h uploader) serveHTTPUploadPOST(w http.ResponseWriter, r *http.Request) {
 			if partErr == io.EOF {
 				break //just an eof...not an error
 			} else {
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(partErr, &maxBytesErr) {
+					log.Printf("request body exceeded MaxRequestBytes")
+					http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+					return
+				}
 				log.Printf("error getting a part %v", partErr)
 				http.Error(w, "error getting a part", 500)
 				return
@@ -221,10 +347,20 @@ func (h uploader) serveHTTPUploadPOST(w http.ResponseWriter, r *http.Request) {
 			} else {
 				if len(part.FileName()) > 0 {
 					if isAuthorized {
-						fileName := h.HomeBucket + "/" + part.FileName()
+						filesSeen++
+						if h.MaxFilesPerRequest > 0 && filesSeen > h.MaxFilesPerRequest {
+							log.Printf("too many files in request, limit is %d", h.MaxFilesPerRequest)
+							http.Error(w, "too many files in request", http.StatusRequestEntityTooLarge)
+							return
+						}
+						fileName := part.FileName()
 						//Could take an *indefinite* amount of time!!
-						err := h.serveHTTPUploadPOSTDrain(fileName, w, part)
-						if err != nil {
+						err := h.serveHTTPUploadPOSTDrain(fileName, w, part, r)
+						if err == errFileTooLarge {
+							log.Printf("file %s exceeded MaxFileBytes", fileName)
+							http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+							return
+						} else if err != nil {
 							log.Printf("error draining part: %v", err)
 						}
 					} else {
@@ -250,32 +386,137 @@ func (h uploader) serveHTTPUploadGET(w http.ResponseWriter, r *http.Request) {
 Efficiently retrieve a file
 */
 func (h uploader) serveHTTPDownloadGET(w http.ResponseWriter, r *http.Request) {
-	fileName := h.HomeBucket + "/" + r.URL.RequestURI()[len("/download/"):]
+	fileName := r.URL.RequestURI()[len("/download/"):]
 	log.Printf("download request for %s", fileName)
-	downloadFrom, err := os.Open(fileName)
+	downloadFrom, err := h.Source.NewSource(fileName)
 	if err != nil {
 		log.Print("failed to open file for reading")
 		http.Error(w, "failed to open file for reading", 500)
 		return
 	}
 	defer downloadFrom.Close()
-	doCipherByReaderWriter(downloadFrom, w, h.Key, h.IV)
+
+	timer := newProgressTimer(w, h.IdleDownloadTimeout)
+	timer.touch()
+
+	iv := h.IV
+	var cipherText io.Reader
+
+	seekable, ok := downloadFrom.(statReaderAt)
+	if !ok {
+		// A purely streaming Source (e.g. a cloud GetObject body) has no
+		// random access, so buffer it to a local temp file first. That
+		// gives it the same random access as local disk: find the
+		// trailer, verify the HMAC tag before any plaintext reaches the
+		// client, and trim the trailer off instead of streaming it out
+		// as 32 bytes of garbage appended to the file.
+		tmp, err := os.CreateTemp("", "uploader-download-*")
+		if err != nil {
+			log.Printf("failed to buffer %s for reading: %v", fileName, err)
+			http.Error(w, "failed to open file for reading", 500)
+			return
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		if _, err := io.Copy(tmp, downloadFrom); err != nil {
+			log.Printf("failed to buffer %s for reading: %v", fileName, err)
+			http.Error(w, "failed to open file for reading", 500)
+			return
+		}
+		seekable = tmp
+	}
+
+	// A random-access Source (local disk, or the temp file a streaming
+	// Source was just buffered into) can verify the HMAC tag before any
+	// plaintext reaches the client.
+	info, err := seekable.Stat()
+	if err != nil {
+		log.Printf("failed to stat file for reading: %v", err)
+		http.Error(w, "failed to stat file for reading", 500)
+		return
+	}
+
+	var headerSize, trailerSize int64
+	header, err := readFileHeader(io.NewSectionReader(seekable, 0, info.Size()))
+	switch {
+	case err == nil:
+		iv = header.IV
+		headerSize = header.HeaderSize
+		trailerSize = hmacTagSize
+	case err == errNotFramed:
+		// Legacy file written before per-file IVs; fall back to
+		// the fixed server-wide IV and skip HMAC verification.
+	default:
+		log.Printf("failed to read file header: %v", err)
+		http.Error(w, "failed to read file header", 500)
+		return
+	}
+
+	cipherSize := info.Size() - headerSize - trailerSize
+	if cipherSize < 0 {
+		log.Printf("file %s is shorter than its own header", fileName)
+		http.Error(w, "corrupt file", 500)
+		return
+	}
+
+	if trailerSize > 0 {
+		tag := make([]byte, trailerSize)
+		if _, err := seekable.ReadAt(tag, headerSize+cipherSize); err != nil {
+			log.Printf("failed to read HMAC tag: %v", err)
+			http.Error(w, "failed to read HMAC tag", 500)
+			return
+		}
+		if err := verifyHMAC(h.Key, io.NewSectionReader(seekable, headerSize, cipherSize), tag); err != nil {
+			log.Printf("HMAC verification failed for %s: %v", fileName, err)
+			http.Error(w, "file failed integrity check", 400)
+			return
+		}
+	}
+
+	cipherText = io.NewSectionReader(seekable, headerSize, cipherSize)
+
+	flusher, _ := w.(http.Flusher)
+	throttled := &throttledWriter{w: w, buckets: []*tokenBucket{h.DownloadBucket, queryBytesPerSec(r, "maxDownloadBytesPerSec")}, flusher: flusher}
+	progressOut := &progressWriter{w: throttled, timer: timer}
+	n, _ := doCipherByReaderWriter(cipherText, progressOut, h.Key, iv)
+	addDownloadBytes(n)
 }
 
 /**
   Handle command routing explicitly.
 */
 func (h uploader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.Compare(r.URL.RequestURI(), "/metrics") == 0 {
+		serveMetrics(w, r)
+		return
+	}
 	if strings.Compare(r.URL.RequestURI(), "/upload") == 0 {
 		if strings.Compare(r.Method, "GET") == 0 {
 			h.serveHTTPUploadGET(w, r)
 		} else {
 			if strings.Compare(r.Method, "POST") == 0 {
+				release, ok := h.admit(w)
+				if !ok {
+					return
+				}
+				defer release()
 				h.serveHTTPUploadPOST(w, r)
 			}
 		}
 	} else {
-		if strings.HasPrefix(r.URL.RequestURI(), "/download/") {
+		if strings.HasPrefix(r.URL.Path, chunksPrefix) {
+			release, ok := h.admit(w)
+			if !ok {
+				return
+			}
+			defer release()
+			h.serveHTTPUploadChunks(w, r)
+		} else if strings.HasPrefix(r.URL.RequestURI(), "/download/") {
+			release, ok := h.admit(w)
+			if !ok {
+				return
+			}
+			defer release()
 			h.serveHTTPDownloadGET(w, r)
 		}
 	}
@@ -291,6 +532,13 @@ func makeServer(
 	bind string,
 	port int,
 	uploadCookie string,
+	backend string,
+	maxConcurrentSessions int,
+	maxUploadBytesPerSec int64,
+	maxDownloadBytesPerSec int64,
+	maxRequestBytes int64,
+	maxFileBytes int64,
+	maxFilesPerRequest int,
 ) *http.Server {
 	//Just ensure that this directory exists
 	os.Mkdir(theRoot, 0700)
@@ -303,13 +551,42 @@ func makeServer(
 	}
 	h.Addr = h.Bind + ":" + strconv.Itoa(h.Port)
 	h.Key = []byte("asdfaddsfadfasdf2543654321546788")
+	h.Sessions = newSessionStore()
+	if err := h.Sessions.load(h.HomeBucket); err != nil {
+		log.Printf("error loading resumable upload sessions: %v", err)
+	}
+	h.MaxUploadBytesPerSec = maxUploadBytesPerSec
+	h.MaxDownloadBytesPerSec = maxDownloadBytesPerSec
+	h.UploadBucket = newTokenBucket(h.MaxUploadBytesPerSec)
+	h.DownloadBucket = newTokenBucket(h.MaxDownloadBytesPerSec)
+
+	h.MaxRequestBytes = maxRequestBytes
+	h.MaxFileBytes = maxFileBytes
+	h.MaxFilesPerRequest = maxFilesPerRequest
 
-	//A web server is running
+	if backend == "" {
+		backend = theRoot
+	}
+	sink, source, err := parseBackend(backend)
+	if err != nil {
+		log.Fatalf("invalid storage backend %q: %v", backend, err)
+	}
+	h.Sink = sink
+	h.Source = source
+	h.IdleUploadTimeout = 60 * time.Second
+	h.IdleDownloadTimeout = 60 * time.Second
+
+	h.MaxConcurrentSessions = maxConcurrentSessions
+	if h.MaxConcurrentSessions > 0 {
+		h.AdmissionSlots = make(chan struct{}, h.MaxConcurrentSessions)
+	}
+
+	//A web server is running. ReadTimeout/WriteTimeout are deliberately
+	//left at zero: progressTimer enforces a per-request idle timeout
+	//instead, so a slow-but-steady transfer of any size can still finish.
 	return &http.Server{
 		Addr:           h.Addr,
 		Handler:        h,
-		ReadTimeout:    10000 * time.Second, //This breaks big downloads
-		WriteTimeout:   10000 * time.Second,
 		MaxHeaderBytes: 1 << 20, //This prevents clients from DOS'ing us
 	}
 }
@@ -318,13 +595,22 @@ func makeServer(
   Use the lowest level of control for creating the Server
   so that we know what all of the options are.
 
-  Timeouts really should handled in the URL handler.
-  Timeout should be based on lack of progress,
-  rather than total time (ie: should active telnet sessions die based on time?),
-  because large files just take longer.
+  Timeouts are handled in the URL handlers via progressTimer
+  (idle.go), based on lack of progress rather than total time
+  (ie: should active telnet sessions die based on time?), because
+  large files just take longer.
 */
 func main() {
-	s := makeServer("/tmp/uploader", "127.0.0.1", 6060, "y0UMayUpL0Ad")
+	backend := flag.String("backend", "", "storage backend for uploaded files, e.g. s3://bucket or gcs://bucket (default: local disk under the root)")
+	maxConcurrentSessions := flag.Int("maxConcurrentSessions", 100, "cap on upload/download/chunk sessions admitted at once (0 = unlimited)")
+	maxUploadBytesPerSec := flag.Int64("maxUploadBytesPerSec", 50*1024*1024, "combined throughput cap across all uploads, in bytes/sec (0 = unlimited)")
+	maxDownloadBytesPerSec := flag.Int64("maxDownloadBytesPerSec", 50*1024*1024, "combined throughput cap across all downloads, in bytes/sec (0 = unlimited)")
+	maxRequestBytes := flag.Int64("maxRequestBytes", 1<<30, "cap on a whole upload request body, in bytes (0 = unlimited)")
+	maxFileBytes := flag.Int64("maxFileBytes", 1<<30, "cap on any single uploaded file's decoded size, in bytes (0 = unlimited)")
+	maxFilesPerRequest := flag.Int("maxFilesPerRequest", 100, "cap on the number of file parts in one upload request (0 = unlimited)")
+	flag.Parse()
+
+	s := makeServer("/tmp/uploader", "127.0.0.1", 6060, "y0UMayUpL0Ad", *backend, *maxConcurrentSessions, *maxUploadBytesPerSec, *maxDownloadBytesPerSec, *maxRequestBytes, *maxFileBytes, *maxFilesPerRequest)
 	log.Printf("open a browser at: %s", "https://"+s.Addr+"/upload")
 	log.Fatal(s.ListenAndServeTLS("cert.pem", "key.pem"))
 }